@@ -6,10 +6,13 @@ package main
 
 import (
 	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
 	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net/url"
@@ -17,7 +20,9 @@ import (
 	"regexp"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 const AppVersion = "1.1.2"
@@ -50,10 +55,24 @@ type Redirect struct {
 type Page struct {
 	Title          string   `xml:"title" json:"title"`
 	CanonicalTitle string   `xml:"ctitle" json:"ctitle"`
+	Ns             int      `xml:"ns" json:"ns"`
 	Redir          Redirect `xml:"redirect" json:"redirect"`
 	Text           string   `xml:"revision>text" json:"text"`
 }
 
+// A single namespace declaration from a dump's <siteinfo> header, e.g.
+// <namespace key="14" case="first-letter">Category</namespace>.
+type Namespace struct {
+	Key  int    `xml:"key,attr"`
+	Name string `xml:",chardata"`
+}
+
+// The <siteinfo> header present at the top of every Wikimedia XML
+// dump, carrying the localized namespace names for that wiki.
+type SiteInfo struct {
+	Namespaces []Namespace `xml:"namespaces>namespace"`
+}
+
 // A page as it occurs on Wikidata, content will be turned from a string
 // into a substructure with -d switch
 type WikidataPage struct {
@@ -63,6 +82,29 @@ type WikidataPage struct {
 	Content        interface{} `json:"content"`
 }
 
+// A page with its wikitext markup stripped down to plain text, for
+// consumers (NLP, indexing, ...) that would otherwise have to parse
+// wikitext themselves.
+type PlainPage struct {
+	Title          string `json:"title"`
+	CanonicalTitle string `json:"ctitle"`
+	Plaintext      string `json:"plaintext"`
+}
+
+// An article as it occurs in a Wikipedia "abstracts" dump, e.g.
+// enwiki-latest-abstract.xml, whose root element is <feed> and whose
+// records are <doc> rather than <page>.
+type Article struct {
+	Title          string `xml:"title" json:"title"`
+	CanonicalTitle string `xml:"ctitle" json:"ctitle"`
+	URL            string `xml:"url" json:"url"`
+	Abstract       string `xml:"abstract" json:"abstract"`
+}
+
+// abstract dumps prefix every title with "Wikipedia:", an artifact of
+// the dump format rather than a real namespace prefix.
+var abstractTitlePrefixPattern = regexp.MustCompile(`(?i)^Wikipedia:\s*`)
+
 func CanonicalizeTitle(title string) string {
 	can := strings.ToLower(title)
 	can = strings.Replace(can, " ", "_", -1)
@@ -70,11 +112,104 @@ func CanonicalizeTitle(title string) string {
 	return can
 }
 
+// NamespaceFilter decides whether a page should be dropped, based on
+// its numeric namespace key. When the dump carries a <siteinfo>
+// header, inclusion/exclusion is driven by the -ns/-ns-exclude keys
+// and the page's own <ns>; without one (older or third-party dumps),
+// it falls back to the legacy English/German namespace-prefix regex.
+type NamespaceFilter struct {
+	included     map[int]bool
+	excluded     map[int]bool
+	prefixes     map[string]int // localized namespace name (lowercased) -> key
+	fallback     *regexp.Regexp
+	haveSiteinfo bool
+}
+
+func parseNsKeys(s string) map[int]bool {
+	keys := make(map[int]bool)
+	for _, tok := range strings.Split(s, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+		if key, err := strconv.Atoi(tok); err == nil {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// NewNamespaceFilter builds a filter from the -ns/-ns-exclude flag
+// values and the legacy regex fallback.
+func NewNamespaceFilter(include, exclude string, fallback *regexp.Regexp) *NamespaceFilter {
+	return &NamespaceFilter{
+		included: parseNsKeys(include),
+		excluded: parseNsKeys(exclude),
+		prefixes: make(map[string]int),
+		fallback: fallback,
+	}
+}
+
+// LoadSiteInfo records the localized namespace names found in a dump's
+// <siteinfo> header, switching the filter from regex fallback to
+// namespace-key matching.
+func (nf *NamespaceFilter) LoadSiteInfo(si SiteInfo) {
+	for _, ns := range si.Namespaces {
+		name := strings.ToLower(strings.TrimSpace(ns.Name))
+		if name != "" {
+			nf.prefixes[name] = ns.Key
+		}
+	}
+	nf.haveSiteinfo = len(si.Namespaces) > 0
+}
+
+// Excluded reports whether p should be dropped from the output.
+func (nf *NamespaceFilter) Excluded(p *Page) bool {
+	if !nf.haveSiteinfo {
+		return nf.fallback.MatchString(p.CanonicalTitle)
+	}
+	if nf.excluded[p.Ns] {
+		return true
+	}
+	if len(nf.included) > 0 {
+		return !nf.included[p.Ns]
+	}
+	return false
+}
+
+// ExcludedTitle reports whether a title belongs to an excluded
+// namespace, for callers that only have a title string to go on rather
+// than a Page with its own <ns> -- abstracts dumps (which carry no
+// <ns>) and wikilink targets found inside another page's wikitext. name
+// is expected lowercased, e.g. "category:foo" or just "category:".
+// Without a <siteinfo> header, this falls back to the legacy
+// English/German prefix regex, same as Excluded.
+func (nf *NamespaceFilter) ExcludedTitle(name string) bool {
+	if !nf.haveSiteinfo {
+		return nf.fallback.MatchString(name)
+	}
+	idx := strings.Index(name, ":")
+	if idx == -1 {
+		return false
+	}
+	key, ok := nf.prefixes[name[:idx]]
+	if !ok {
+		return false
+	}
+	if nf.excluded[key] {
+		return true
+	}
+	if len(nf.included) > 0 {
+		return !nf.included[key]
+	}
+	return false
+}
+
 // category extraction worker
 func CategoryExtractor(in chan *Page,
 	out chan *string,
 	ack chan bool,
-	filter *regexp.Regexp,
+	nsFilter *NamespaceFilter,
 	categoryPattern *regexp.Regexp) {
 	var pp *Page
 	for {
@@ -88,8 +223,7 @@ func CategoryExtractor(in chan *Page,
 
 		// do some stuff with the page
 		p.CanonicalTitle = CanonicalizeTitle(p.Title)
-		m := filter.MatchString(p.CanonicalTitle)
-		if !m && p.Redir.Title == "" {
+		if !nsFilter.Excluded(&p) && p.Redir.Title == "" {
 
 			// specific to category extraction
 			result := categoryPattern.FindAllStringSubmatch(p.Text, -1)
@@ -113,7 +247,7 @@ func CategoryExtractor(in chan *Page,
 func AuthorityDataExtractor(in chan *Page,
 	out chan *string,
 	ack chan bool,
-	filter *regexp.Regexp,
+	nsFilter *NamespaceFilter,
 	authorityDataPattern *regexp.Regexp) {
 	var pp *Page
 	for {
@@ -127,8 +261,7 @@ func AuthorityDataExtractor(in chan *Page,
 
 		// do some stuff with the page
 		p.CanonicalTitle = CanonicalizeTitle(p.Title)
-		m := filter.MatchString(p.CanonicalTitle)
-		if !m && p.Redir.Title == "" {
+		if !nsFilter.Excluded(&p) && p.Redir.Title == "" {
 
 			// specific to category extraction
 			result := authorityDataPattern.FindString(p.Text)
@@ -144,11 +277,502 @@ func AuthorityDataExtractor(in chan *Page,
 	ack <- true
 }
 
+// One occurrence of a requested template/infobox on a page, emitted by
+// the -t worker.
+type TemplatePage struct {
+	Title    string            `json:"title"`
+	Template string            `json:"template"`
+	Params   map[string]string `json:"params"`
+}
+
+var htmlCommentPattern = regexp.MustCompile(`(?s)<!--.*?-->`)
+
+// normalizeTemplateName folds a template name the way MediaWiki does
+// for matching purposes: case and underscore/space insensitive.
+func normalizeTemplateName(name string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(name), "_", " ", -1))
+}
+
+// scanTemplateBody scans text starting right after a template's name
+// (pos) until the matching "}}", counting {{ }} nesting depth so an
+// inner template doesn't end the scan early. It returns the raw body
+// between the name and the closing "}}", and the index just past it
+// (or -1 if the template is unterminated).
+func scanTemplateBody(text string, pos int) (string, int) {
+	depth := 1
+	for i := pos; i < len(text); {
+		switch {
+		case strings.HasPrefix(text[i:], "{{"):
+			depth++
+			i += 2
+		case strings.HasPrefix(text[i:], "}}"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return text[pos : i-2], i
+			}
+		default:
+			i++
+		}
+	}
+	return "", -1
+}
+
+// splitTopLevel splits s on sep, ignoring any sep found nested inside
+// {{ }} templates or [[ ]] links.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	braceDepth, linkDepth, last := 0, 0, 0
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			braceDepth++
+			i += 2
+		case strings.HasPrefix(s[i:], "}}"):
+			if braceDepth > 0 {
+				braceDepth--
+			}
+			i += 2
+		case strings.HasPrefix(s[i:], "[["):
+			linkDepth++
+			i += 2
+		case strings.HasPrefix(s[i:], "]]"):
+			if linkDepth > 0 {
+				linkDepth--
+			}
+			i += 2
+		case s[i] == sep && braceDepth == 0 && linkDepth == 0:
+			parts = append(parts, s[last:i])
+			i++
+			last = i
+		default:
+			i++
+		}
+	}
+	return append(parts, s[last:])
+}
+
+// splitFirstTopLevel splits s on the first top-level occurrence of
+// sep, respecting the same {{ }} / [[ ]] nesting as splitTopLevel.
+func splitFirstTopLevel(s string, sep byte) (before, after string, ok bool) {
+	braceDepth, linkDepth := 0, 0
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			braceDepth++
+			i += 2
+		case strings.HasPrefix(s[i:], "}}"):
+			if braceDepth > 0 {
+				braceDepth--
+			}
+			i += 2
+		case strings.HasPrefix(s[i:], "[["):
+			linkDepth++
+			i += 2
+		case strings.HasPrefix(s[i:], "]]"):
+			if linkDepth > 0 {
+				linkDepth--
+			}
+			i += 2
+		case s[i] == sep && braceDepth == 0 && linkDepth == 0:
+			return s[:i], s[i+1:], true
+		default:
+			i++
+		}
+	}
+	return s, "", false
+}
+
+// parseTemplateParams splits a template body on its top-level "|"
+// separators, then each part on the first top-level "=" into a
+// name/value pair; unnamed parts get positional keys "1", "2", ...
+func parseTemplateParams(body string) map[string]string {
+	params := make(map[string]string)
+	body = strings.TrimLeft(body, " \t\n")
+	body = strings.TrimPrefix(body, "|")
+	if strings.TrimSpace(body) == "" {
+		return params
+	}
+	positional := 0
+	for _, part := range splitTopLevel(body, '|') {
+		if name, value, named := splitFirstTopLevel(part, '='); named {
+			params[strings.TrimSpace(name)] = strings.TrimSpace(htmlCommentPattern.ReplaceAllString(value, ""))
+		} else {
+			positional++
+			params[strconv.Itoa(positional)] = strings.TrimSpace(htmlCommentPattern.ReplaceAllString(part, ""))
+		}
+	}
+	return params
+}
+
+// ExtractTemplates finds every occurrence of templateName in text and
+// returns its parameters, one map per occurrence. Brace depth counting
+// lets it handle templates nested inside e.g. an Infobox's parameters.
+func ExtractTemplates(text, templateName string) []map[string]string {
+	target := normalizeTemplateName(templateName)
+	var results []map[string]string
+	for i := 0; i < len(text); {
+		oi := strings.Index(text[i:], "{{")
+		if oi == -1 {
+			break
+		}
+		start := i + oi
+		nameEnd := start + 2
+		for nameEnd < len(text) && text[nameEnd] != '|' && text[nameEnd] != '}' && text[nameEnd] != '\n' {
+			nameEnd++
+		}
+		if normalizeTemplateName(text[start+2:nameEnd]) != target {
+			i = start + 2
+			continue
+		}
+		body, end := scanTemplateBody(text, nameEnd)
+		if end == -1 {
+			break
+		}
+		results = append(results, parseTemplateParams(body))
+		i = end
+	}
+	return results
+}
+
+// template/infobox extraction worker
+func TemplateExtractor(in chan *Page,
+	out chan *string,
+	ack chan bool,
+	nsFilter *NamespaceFilter,
+	templateName string) {
+	var pp *Page
+	for {
+		// get the page pointer
+		pp = <-in
+		if pp == nil {
+			break
+		}
+		// get the page
+		p := *pp
+
+		// do some stuff with the page
+		p.CanonicalTitle = CanonicalizeTitle(p.Title)
+		if !nsFilter.Excluded(&p) && p.Redir.Title == "" {
+			for _, params := range ExtractTemplates(p.Text, templateName) {
+				tp := TemplatePage{Title: p.Title, Template: templateName, Params: params}
+				b, err := json.Marshal(tp)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					continue
+				}
+				line := string(b)
+				out <- &line
+			}
+		}
+	}
+	ack <- true
+}
+
+// A single outbound wikilink found on a page.
+type WikiLink struct {
+	Target string
+	Anchor string
+}
+
+// scanLinkBody scans text starting right after a link's opening "[["
+// (pos) until the matching "]]", counting nesting depth so a link
+// nested inside e.g. an image/file caption doesn't end the scan early.
+// It returns the raw body between the brackets and the index just
+// past the closing "]]" (or -1 if unterminated).
+func scanLinkBody(text string, pos int) (string, int) {
+	depth := 1
+	for i := pos; i < len(text); {
+		switch {
+		case strings.HasPrefix(text[i:], "[["):
+			depth++
+			i += 2
+		case strings.HasPrefix(text[i:], "]]"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return text[pos : i-2], i
+			}
+		default:
+			i++
+		}
+	}
+	return "", -1
+}
+
+// ExtractLinks scans text for [[...]] wikilinks, handling links
+// nested inside image/file captions via scanLinkBody's depth
+// counting, and splitting each body on the first top-level "|" into
+// target and anchor (anchor defaults to the target when there is
+// none). A caption can itself carry further [[...]] links (e.g. an
+// image's caption linking to another article), so it is recursively
+// rescanned for those instead of being treated as opaque text.
+func ExtractLinks(text string) []WikiLink {
+	var links []WikiLink
+	for i := 0; i < len(text); {
+		oi := strings.Index(text[i:], "[[")
+		if oi == -1 {
+			break
+		}
+		start := i + oi
+		body, end := scanLinkBody(text, start+2)
+		if end == -1 {
+			break
+		}
+		target, anchor, hasAnchor := splitFirstTopLevel(body, '|')
+		if !hasAnchor {
+			anchor = target
+		}
+		links = append(links, WikiLink{
+			Target: strings.TrimSpace(target),
+			Anchor: strings.TrimSpace(anchor),
+		})
+		if hasAnchor {
+			links = append(links, ExtractLinks(anchor)...)
+		}
+		i = end
+	}
+	return links
+}
+
+// link-graph extraction worker: emits one TSV line per outbound
+// wikilink on out, and redirects (from, to) on redirOut so downstream
+// tools can resolve them and compose the final pagelinks graph.
+func LinkExtractor(in chan *Page,
+	out chan *string,
+	redirOut chan *string,
+	ack chan bool,
+	nsFilter *NamespaceFilter) {
+	var pp *Page
+	for {
+		// get the page pointer
+		pp = <-in
+		if pp == nil {
+			break
+		}
+		// get the page
+		p := *pp
+
+		// do some stuff with the page
+		p.CanonicalTitle = CanonicalizeTitle(p.Title)
+		if nsFilter.Excluded(&p) {
+			continue
+		}
+		if p.Redir.Title != "" {
+			line := fmt.Sprintf("%s\t%s", p.Title, CanonicalizeTitle(p.Redir.Title))
+			redirOut <- &line
+			continue
+		}
+
+		for _, link := range ExtractLinks(p.Text) {
+			target := link.Target
+			if idx := strings.Index(target, "#"); idx != -1 {
+				target = target[:idx]
+			}
+			target = strings.TrimSpace(target)
+			if target == "" {
+				continue
+			}
+			if idx := strings.Index(target, ":"); idx != -1 {
+				prefix := strings.ToLower(strings.TrimSpace(target[:idx])) + ":"
+				if nsFilter.ExcludedTitle(prefix) {
+					continue
+				}
+			}
+			line := fmt.Sprintf("%s\t%s\t%s", p.Title, CanonicalizeTitle(target), link.Anchor)
+			out <- &line
+		}
+	}
+	ack <- true
+}
+
+var (
+	redirectLinePattern = regexp.MustCompile(`(?i)^#REDIRECT.*$`)
+	tableRowLinePattern = regexp.MustCompile(`(?m)^[|!].*$`)
+	boldItalicPattern   = regexp.MustCompile(`'''?`)
+	bulletIndentPattern = regexp.MustCompile(`(?m)^[ *#:;]+`)
+	tocDirectivePattern = regexp.MustCompile(`__[A-Z]+__`)
+)
+
+// defaultSkipTags lists the HTML-ish tags whose content is dropped
+// wholesale by PlaintextExtractor, mirroring the tags that carry no
+// reader-facing prose in a rendered Wikipedia article.
+var defaultSkipTags = []string{
+	"ref", "cite", "hiero", "gallery", "timeline", "noinclude",
+	"references", "math", "source", "img", "caption",
+}
+
+// stripBalanced removes every top-level run delimited by open/close,
+// counting nesting depth so that, for example, a template containing
+// another template is consumed as a single unit.
+func stripBalanced(s, open, close string) string {
+	var b strings.Builder
+	depth := 0
+	for i := 0; i < len(s); {
+		if depth == 0 {
+			oi := strings.Index(s[i:], open)
+			if oi == -1 {
+				b.WriteString(s[i:])
+				break
+			}
+			b.WriteString(s[i : i+oi])
+			i += oi + len(open)
+			depth = 1
+			continue
+		}
+		oi := strings.Index(s[i:], open)
+		ci := strings.Index(s[i:], close)
+		if ci == -1 {
+			// unterminated, drop the remainder
+			break
+		}
+		if oi != -1 && oi < ci {
+			depth++
+			i += oi + len(open)
+		} else {
+			depth--
+			i += ci + len(close)
+		}
+	}
+	return b.String()
+}
+
+// compileSkipTagPatterns compiles the per-tag regex used by
+// stripSkipTags once per tag, so callers on a hot per-page path (like
+// PlaintextExtractor) don't pay to recompile it on every call.
+func compileSkipTagPatterns(tags []string) []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		patterns = append(patterns, regexp.MustCompile(`(?is)<`+tag+`\b[^>]*/>|<`+tag+`\b[^>]*>.*?</`+tag+`\s*>`))
+	}
+	return patterns
+}
+
+// stripSkipTags removes the full contents of non-nesting HTML-ish spans
+// matched by patterns, e.g. <ref>...</ref> or the self-closing
+// <ref .../> form.
+func stripSkipTags(s string, patterns []*regexp.Regexp) string {
+	for _, pattern := range patterns {
+		s = pattern.ReplaceAllString(s, "")
+	}
+	return s
+}
+
+// collapseWikiLinks turns [[target|...|anchor]] into anchor (the last
+// pipe-separated segment, matching MediaWiki's own image/link syntax,
+// e.g. [[File:x.jpg|thumb|a caption]]) and [[target]] into target,
+// dropping the whole link when its target namespace is excluded per nf
+// (driven by the dump's own <siteinfo> when available, so this works
+// across languages, not just English/German). Uses the same
+// brace/bracket-depth scanner as ExtractLinks, so a link nested inside
+// e.g. an image caption is collapsed in its own right rather than
+// corrupting the enclosing match.
+func collapseWikiLinks(s string, nf *NamespaceFilter) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		oi := strings.Index(s[i:], "[[")
+		if oi == -1 {
+			b.WriteString(s[i:])
+			break
+		}
+		start := i + oi
+		b.WriteString(s[i:start])
+		body, end := scanLinkBody(s, start+2)
+		if end == -1 {
+			b.WriteString(s[start:])
+			break
+		}
+		parts := splitTopLevel(body, '|')
+		target := strings.TrimSpace(parts[0])
+		if idx := strings.Index(target, ":"); idx != -1 {
+			prefix := strings.ToLower(target[:idx]) + ":"
+			if nf.ExcludedTitle(prefix) {
+				i = end
+				continue
+			}
+		}
+		anchor := target
+		if len(parts) > 1 {
+			anchor = parts[len(parts)-1]
+		}
+		b.WriteString(collapseWikiLinks(anchor, nf))
+		i = end
+	}
+	return b.String()
+}
+
+// CleanWikitext strips MediaWiki markup from text, leaving plain
+// reader-facing prose: tag spans matched by skipPatterns are dropped, tables and
+// templates are removed with brace/pipe depth counting, links are
+// collapsed to their anchor text, and the remaining markup noise
+// (bullets, bold/italic markers, TOC directives) and HTML entities are
+// cleaned up.
+func CleanWikitext(text string, skipPatterns []*regexp.Regexp, nf *NamespaceFilter) string {
+	lines := strings.SplitN(text, "\n", 2)
+	if redirectLinePattern.MatchString(lines[0]) {
+		if len(lines) == 2 {
+			text = lines[1]
+		} else {
+			text = ""
+		}
+	}
+	text = stripSkipTags(text, skipPatterns)
+	text = stripBalanced(text, "{|", "|}")
+	text = tableRowLinePattern.ReplaceAllString(text, "")
+	text = stripBalanced(text, "{{", "}}")
+	text = collapseWikiLinks(text, nf)
+	text = bulletIndentPattern.ReplaceAllString(text, "")
+	text = boldItalicPattern.ReplaceAllString(text, "")
+	text = tocDirectivePattern.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	return text
+}
+
+// plaintext extraction worker
+func PlaintextExtractor(in chan *Page,
+	out chan *string,
+	ack chan bool,
+	nsFilter *NamespaceFilter,
+	skipPatterns []*regexp.Regexp) {
+	var pp *Page
+	for {
+		// get the page pointer
+		pp = <-in
+		if pp == nil {
+			break
+		}
+		// get the page
+		p := *pp
+
+		// do some stuff with the page
+		p.CanonicalTitle = CanonicalizeTitle(p.Title)
+		if !nsFilter.Excluded(&p) && p.Redir.Title == "" {
+			plain := PlainPage{
+				Title:          p.Title,
+				CanonicalTitle: p.CanonicalTitle,
+				Plaintext:      CleanWikitext(p.Text, skipPatterns, nsFilter),
+			}
+			b, err := json.Marshal(plain)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			} else {
+				line := string(b)
+				out <- &line
+			}
+		}
+	}
+	ack <- true
+}
+
 // wikidata to json worker
 func WikidataEncoder(in chan *Page,
 	out chan *string,
 	ack chan bool,
-	filter *regexp.Regexp) {
+	nsFilter *NamespaceFilter) {
 
 	var container interface{}
 	var pp *Page
@@ -164,8 +788,7 @@ func WikidataEncoder(in chan *Page,
 
 		// do some stuff with the page
 		p.CanonicalTitle = CanonicalizeTitle(p.Title)
-		m := filter.MatchString(p.CanonicalTitle)
-		if !m && p.Redir.Title == "" {
+		if !nsFilter.Excluded(&p) && p.Redir.Title == "" {
 			dec := json.NewDecoder(strings.NewReader(p.Text))
 			dec.UseNumber()
 
@@ -199,7 +822,7 @@ func WikidataEncoder(in chan *Page,
 func VanillaConverter(in chan *Page,
 	out chan *string,
 	ack chan bool,
-	filter *regexp.Regexp) {
+	nsFilter *NamespaceFilter) {
 	var pp *Page
 	for {
 		// get the page pointer
@@ -212,8 +835,7 @@ func VanillaConverter(in chan *Page,
 
 		// do some stuff with the page
 		p.CanonicalTitle = CanonicalizeTitle(p.Title)
-		m := filter.MatchString(p.CanonicalTitle)
-		if !m && p.Redir.Title == "" {
+		if !nsFilter.Excluded(&p) && p.Redir.Title == "" {
 			b, err := json.Marshal(p)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
@@ -226,6 +848,37 @@ func VanillaConverter(in chan *Page,
 	ack <- true
 }
 
+// abstract dump encoding worker
+func ArticleEncoder(in chan *Article,
+	out chan *string,
+	ack chan bool,
+	nsFilter *NamespaceFilter) {
+	var ap *Article
+	for {
+		// get the article pointer
+		ap = <-in
+		if ap == nil {
+			break
+		}
+		// get the article
+		a := *ap
+
+		// do some stuff with the article
+		title := abstractTitlePrefixPattern.ReplaceAllString(a.Title, "")
+		a.CanonicalTitle = CanonicalizeTitle(title)
+		if !nsFilter.ExcludedTitle(strings.ToLower(title)) {
+			b, err := json.Marshal(a)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			} else {
+				line := string(b)
+				out <- &line
+			}
+		}
+	}
+	ack <- true
+}
+
 // Collect output and write to Stdout
 func StdoutCollector(lines chan *string) {
 	for line := range lines {
@@ -233,6 +886,14 @@ func StdoutCollector(lines chan *string) {
 	}
 }
 
+// Collect output and write to Stderr, used for secondary streams
+// (e.g. -l's redirects) that have no dedicated output file
+func StderrCollector(lines chan *string) {
+	for line := range lines {
+		fmt.Fprintln(os.Stderr, *line)
+	}
+}
+
 // Collect output and write to file
 func FileCollector(lines chan *string, filename string) {
 	output, err := os.Create(filename)
@@ -255,12 +916,155 @@ func FileCollector(lines chan *string, filename string) {
 	w.Flush()
 }
 
+// decompressingReader wraps r with a bzip2 or gzip decompressor
+// chosen by path's extension, so callers don't have to bunzip2/gunzip
+// Wikimedia dumps by hand; any other extension is read as-is.
+func decompressingReader(path string, r io.Reader) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(path, ".bz2"):
+		return bzip2.NewReader(r), nil
+	case strings.HasSuffix(path, ".gz"):
+		return gzip.NewReader(r)
+	default:
+		return r, nil
+	}
+}
+
+// readMultistreamOffsets reads a *-multistream-index.txt(.bz2) file
+// and returns the distinct, ascending byte offsets at which each
+// independent bzip2 stream starts. The index has one "offset:id:title"
+// line per page, with consecutive lines sharing an offset when they
+// belong to the same stream.
+func readMultistreamOffsets(indexFile string) ([]int64, error) {
+	f, err := os.Open(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := decompressingReader(indexFile, f)
+	if err != nil {
+		return nil, err
+	}
+
+	var offsets []int64
+	last := int64(-1)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		offset, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || offset == last {
+			continue
+		}
+		offsets = append(offsets, offset)
+		last = offset
+	}
+	return offsets, scanner.Err()
+}
+
+// partitionOffsets splits the ascending stream offsets into up to
+// groups contiguous [start, end) byte ranges, each covering a roughly
+// equal number of streams, so every goroutine gets its own disjoint
+// section of the file. The last range's end is fileSize.
+func partitionOffsets(offsets []int64, fileSize int64, groups int) [][2]int64 {
+	if len(offsets) == 0 {
+		return nil
+	}
+	if groups > len(offsets) {
+		groups = len(offsets)
+	}
+	per := len(offsets) / groups
+	extra := len(offsets) % groups
+
+	var ranges [][2]int64
+	idx := 0
+	for g := 0; g < groups; g++ {
+		count := per
+		if g < extra {
+			count++
+		}
+		start := offsets[idx]
+		idx += count
+		end := fileSize
+		if idx < len(offsets) {
+			end = offsets[idx]
+		}
+		ranges = append(ranges, [2]int64{start, end})
+	}
+	return ranges
+}
+
+// decodeMultistreamRange parses the <page> elements out of a
+// contiguous run of concatenated bzip2 streams (bzip2.Reader follows
+// straight through from one concatenated stream into the next),
+// pushing each onto in.
+func decodeMultistreamRange(file *os.File, start, length int64, in chan *Page) {
+	sr := io.NewSectionReader(file, start, length)
+	decoder := xml.NewDecoder(bzip2.NewReader(sr))
+	for {
+		t, err := decoder.Token()
+		if t == nil || err != nil {
+			return
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "page" {
+			continue
+		}
+		var p Page
+		if err := decoder.DecodeElement(&p, &se); err != nil {
+			return
+		}
+		in <- &p
+	}
+}
+
+// decodeLeadingSiteInfo decodes the header bzip2 stream that precedes a
+// multistream dump's first indexed offset (a <mediawiki><siteinfo>...
+// header, not itself listed in the multistream index) and loads its
+// <siteinfo> into nf, so -ns/-ns-exclude keep working in -index mode.
+func decodeLeadingSiteInfo(file *os.File, end int64, nf *NamespaceFilter) {
+	if end <= 0 {
+		return
+	}
+	sr := io.NewSectionReader(file, 0, end)
+	decoder := xml.NewDecoder(bzip2.NewReader(sr))
+	for {
+		t, err := decoder.Token()
+		if t == nil || err != nil {
+			return
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "siteinfo" {
+			continue
+		}
+		var si SiteInfo
+		if err := decoder.DecodeElement(&si, &se); err != nil {
+			return
+		}
+		nf.LoadSiteInfo(si)
+		return
+	}
+}
+
 func main() {
 
 	version := flag.Bool("v", false, "prints current version and exits")
 	extractCategories := flag.String("c", "", "only extract categories TSV(page, category), argument is the prefix, e.g. Kategorie or Category, ... ")
 	extractAuthorityData := flag.String("a", "", "only extract authority data (Normdaten, Authority control, ...)")
+	extractTemplate := flag.String("t", "", "extract every occurrence of the named template/infobox as structured JSON (brace-balanced, handles nesting)")
+	extractLinks := flag.Bool("l", false, "emit a TSV pagelinks graph (source_title, target_title, anchor) per non-redirect page")
+	redirectsFilename := flag.String("redirects-o", "", "for -l, write from\\tto redirect TSV lines here (stderr, if empty)")
 	decodeWikiData := flag.Bool("d", false, "decode the text key value")
+	extractPlaintext := flag.Bool("p", false, "extract plaintext with wikitext markup stripped")
+	skipTags := flag.String("skip-tags", strings.Join(defaultSkipTags, ","),
+		"comma separated list of tags whose content is dropped in plaintext mode (-p)")
+	abstractsMode := flag.Bool("abstracts", false, "decode a Wikipedia abstracts dump (<doc> records) instead of a pages-articles dump; auto-detected when not given")
+	nsInclude := flag.String("ns", "0", "comma separated namespace keys to include, e.g. 0,14 for main + Category; only used when the dump has a <siteinfo> header")
+	nsExclude := flag.String("ns-exclude", "", "comma separated namespace keys to exclude, applied before -ns")
+	indexFile := flag.String("index", "", "multistream index file (*-multistream-index.txt.bz2), to decode a matching *-multistream.xml.bz2 input across -w parallel bzip2 streams instead of one")
 	numWorkers := flag.Int("w", runtime.NumCPU(), "number of workers")
 	outputFilename := flag.String("o", "", "write output to file (or stdout, if empty)")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
@@ -281,6 +1085,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *indexFile != "" && *abstractsMode {
+		log.Fatal("-index carries pages-articles dumps only, not -abstracts")
+	}
+
 	if *version {
 		fmt.Println(AppVersion)
 		os.Exit(0)
@@ -310,12 +1118,49 @@ func main() {
 	}
 	defer xmlFile.Close()
 
-	// xml decoder
-	decoder := xml.NewDecoder(xmlFile)
+	// namespace filter, falls back to the legacy prefix regex until a
+	// <siteinfo> header (if any) is decoded below
+	namespaceFilter := NewNamespaceFilter(*nsInclude, *nsExclude, filter)
+
+	// compiled once, rather than per page, since -p runs this on every
+	// page in the dump
+	skipPatterns := compileSkipTagPatterns(strings.Split(*skipTags, ","))
+
+	// In multistream mode, each worker goroutine below opens its own
+	// bzip2 stream directly off xmlFile via io.SectionReader, so the
+	// file must stay raw here; otherwise transparently decompress it
+	// based on its extension.
+	var decoder *xml.Decoder
 	var inElement string
+	isAbstracts := *abstractsMode
+
+	if *indexFile == "" {
+		xmlReader, err := decompressingReader(inputFile, xmlFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		decoder = xml.NewDecoder(xmlReader)
+	}
+
+	// Peek at the root element to tell a pages-articles dump
+	// (<mediawiki>, record element "page") apart from an abstracts
+	// dump (<feed>, record element "doc"). Skipped in multistream mode,
+	// which only ever carries pages-articles dumps.
+	for *indexFile == "" {
+		t, _ := decoder.Token()
+		if t == nil {
+			break
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			isAbstracts = isAbstracts || se.Name.Local == "feed"
+			break
+		}
+	}
 
 	// the parsed XML pages channel
 	in := make(chan *Page)
+	// the parsed XML abstract articles channel
+	inArticles := make(chan *Article)
 	// the strings output channel
 	out := make(chan *string)
 	// the quit ack channel
@@ -328,53 +1173,119 @@ func main() {
 		go StdoutCollector(out)
 	}
 
+	// for -l, the separate from/to redirects stream
+	var redirOut chan *string
+	if *extractLinks {
+		redirOut = make(chan *string)
+		if *redirectsFilename != "" {
+			go FileCollector(redirOut, *redirectsFilename)
+		} else {
+			go StderrCollector(redirOut)
+		}
+	}
+
 	// start some appropriate workers
 	for i := 0; i < *numWorkers; i++ {
-		if *extractCategories != "" {
+		if isAbstracts {
+			go ArticleEncoder(inArticles, out, ack, namespaceFilter)
+		} else if *extractCategories != "" {
 			// category pattern depends on the language, e.g. Kategorie or Category, ...
 			pattern := regexp.MustCompile(`\[\[` + *extractCategories + `:([^\[]+)\]\]`)
-			go CategoryExtractor(in, out, ack, filter, pattern)
+			go CategoryExtractor(in, out, ack, namespaceFilter, pattern)
 		} else if *extractAuthorityData != "" {
 			// Authority data (German only for now)
 			pattern := regexp.MustCompile(`(?mi){{` + *extractAuthorityData + `[^}]*}}`)
-			go AuthorityDataExtractor(in, out, ack, filter, pattern)
+			go AuthorityDataExtractor(in, out, ack, namespaceFilter, pattern)
+		} else if *extractTemplate != "" {
+			go TemplateExtractor(in, out, ack, namespaceFilter, *extractTemplate)
+		} else if *extractLinks {
+			go LinkExtractor(in, out, redirOut, ack, namespaceFilter)
 		} else if *decodeWikiData {
-			go WikidataEncoder(in, out, ack, filter)
+			go WikidataEncoder(in, out, ack, namespaceFilter)
+		} else if *extractPlaintext {
+			go PlaintextExtractor(in, out, ack, namespaceFilter, skipPatterns)
 		} else {
-			go VanillaConverter(in, out, ack, filter)
+			go VanillaConverter(in, out, ack, namespaceFilter)
 		}
 	}
 
-	for {
-		// Read tokens from the XML document in a stream.
-		t, _ := decoder.Token()
-		if t == nil {
-			break
+	if *indexFile != "" {
+		// Parallel path: split the multistream file into -w disjoint
+		// byte ranges (one or more concatenated bzip2 streams each,
+		// per the index) and decode them concurrently, instead of the
+		// single-threaded token loop below.
+		fi, err := xmlFile.Stat()
+		if err != nil {
+			log.Fatal(err)
+		}
+		offsets, err := readMultistreamOffsets(*indexFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The header stream (<mediawiki><siteinfo>...) precedes the
+		// first indexed offset and isn't itself listed in the index;
+		// decode it up front so -ns/-ns-exclude aren't silently
+		// no-ops in multistream mode.
+		if len(offsets) > 0 {
+			decodeLeadingSiteInfo(xmlFile, offsets[0], namespaceFilter)
 		}
-		// Inspect the type of the token just read.
-		switch se := t.(type) {
-		case xml.StartElement:
-			// If we just read a StartElement token
-			inElement = se.Name.Local
-			// ...and its name is "page"
-			if inElement == "page" {
-				var p Page
-				// decode a whole chunk of following XML into the
-				// variable p which is a Page (se above)
-				decoder.DecodeElement(&p, &se)
-				in <- &p
+		var wg sync.WaitGroup
+		for _, r := range partitionOffsets(offsets, fi.Size(), *numWorkers) {
+			wg.Add(1)
+			go func(start, end int64) {
+				defer wg.Done()
+				decodeMultistreamRange(xmlFile, start, end-start, in)
+			}(r[0], r[1])
+		}
+		wg.Wait()
+	} else {
+		for {
+			// Read tokens from the XML document in a stream.
+			t, _ := decoder.Token()
+			if t == nil {
+				break
+			}
+			// Inspect the type of the token just read.
+			switch se := t.(type) {
+			case xml.StartElement:
+				// If we just read a StartElement token
+				inElement = se.Name.Local
+				// the <siteinfo> header, if present, carries the localized
+				// namespace names for this wiki
+				if inElement == "siteinfo" {
+					var si SiteInfo
+					decoder.DecodeElement(&si, &se)
+					namespaceFilter.LoadSiteInfo(si)
+				} else if isAbstracts && inElement == "doc" {
+					var a Article
+					decoder.DecodeElement(&a, &se)
+					inArticles <- &a
+				} else if inElement == "page" {
+					var p Page
+					// decode a whole chunk of following XML into the
+					// variable p which is a Page (se above)
+					decoder.DecodeElement(&p, &se)
+					in <- &p
+				}
+			default:
 			}
-		default:
 		}
 	}
 
 	// kill workers
 	for n := 0; n < *numWorkers; n++ {
-		in <- nil
+		if isAbstracts {
+			inArticles <- nil
+		} else {
+			in <- nil
+		}
 	}
 	for n := 0; n < *numWorkers; n++ {
 		<-ack
 	}
-	// close the output channel
+	// close the output channel(s)
 	close(out)
+	if *extractLinks {
+		close(redirOut)
+	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestExtractTemplatesMultilineInfobox(t *testing.T) {
+	text := "{{cite book\n|TitleValue\n|AuthorValue\n}}"
+	results := ExtractTemplates(text, "cite book")
+	if len(results) != 1 {
+		t.Fatalf("expected 1 occurrence, got %d", len(results))
+	}
+	want := map[string]string{"1": "TitleValue", "2": "AuthorValue"}
+	if !reflect.DeepEqual(results[0], want) {
+		t.Errorf("got %v, want %v", results[0], want)
+	}
+}
+
+func TestNamespaceFilterFallsBackWithoutSiteInfo(t *testing.T) {
+	fallback := regexp.MustCompile("^user:.*|^category:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	excluded := &Page{Title: "User:Someone", CanonicalTitle: "user:someone"}
+	included := &Page{Title: "Apollo 11", CanonicalTitle: "apollo_11"}
+	if !nf.Excluded(excluded) {
+		t.Errorf("expected %q to be excluded via fallback regex", excluded.Title)
+	}
+	if nf.Excluded(included) {
+		t.Errorf("expected %q to be included via fallback regex", included.Title)
+	}
+}
+
+func TestNamespaceFilterUsesSiteInfoNsOnceLoaded(t *testing.T) {
+	fallback := regexp.MustCompile("^user:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	nf.LoadSiteInfo(SiteInfo{Namespaces: []Namespace{
+		{Key: 0, Name: ""},
+		{Key: 2, Name: "User"},
+		{Key: 14, Name: "Category"},
+	}})
+
+	// Even though this title would have matched the fallback regex, a
+	// page's numeric ns now decides inclusion, not its title prefix.
+	userByNs := &Page{Title: "User:Someone", CanonicalTitle: "user:someone", Ns: 2}
+	if !nf.Excluded(userByNs) {
+		t.Errorf("expected ns=2 page to be excluded once -ns=0 is active with siteinfo loaded")
+	}
+	mainByNs := &Page{Title: "Apollo 11", CanonicalTitle: "apollo_11", Ns: 0}
+	if nf.Excluded(mainByNs) {
+		t.Errorf("expected ns=0 page to be included once -ns=0 is active with siteinfo loaded")
+	}
+}
+
+func TestExcludedTitleUsesLocalizedPrefixOnceLoaded(t *testing.T) {
+	fallback := regexp.MustCompile("^category:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	nf.LoadSiteInfo(SiteInfo{Namespaces: []Namespace{
+		{Key: 0, Name: ""},
+		{Key: 14, Name: "Kategória"}, // Hungarian for Category
+	}})
+
+	if !nf.ExcludedTitle("kategória:foo") {
+		t.Errorf("expected localized-prefix title to be excluded once siteinfo is loaded")
+	}
+	// The English-only fallback regex would have matched this, but once
+	// siteinfo is loaded only prefixes found in it are consulted.
+	if nf.ExcludedTitle("category:foo") {
+		t.Errorf("expected untranslated English prefix to be included on a wiki whose siteinfo doesn't use it")
+	}
+}
+
+func TestCollapseWikiLinksDropsExcludedNamespace(t *testing.T) {
+	fallback := regexp.MustCompile("^category:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	out := collapseWikiLinks("See [[Category:Foo]] and [[Apollo 11|the mission]].", nf)
+	want := "See  and the mission."
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestCollapseWikiLinksHandlesNestedCaptionLink(t *testing.T) {
+	fallback := regexp.MustCompile("^file:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	out := collapseWikiLinks("A photo of [[File:Jane.jpg|thumb|A photo of [[Jane Doe]] at home]] today.", nf)
+	want := "A photo of  today."
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestCollapseWikiLinksUsesCaptionAsAnchorForKeptLinks(t *testing.T) {
+	// A Gallery: link isn't excluded by this filter, so it's kept; its
+	// anchor is the last pipe-separated segment (the caption), and any
+	// link nested in that caption is itself collapsed, rather than the
+	// "thumb|" option leaking into the output as literal text.
+	fallback := regexp.MustCompile("^file:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	out := collapseWikiLinks("[[Gallery:x.jpg|thumb|A photo of [[Jane Doe|Jane]] at home]]", nf)
+	want := "A photo of Jane at home"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestCleanWikitextStripsTablesTemplatesAndSkipTags(t *testing.T) {
+	text := "Intro.\n{{Infobox foo|a=1}}\n{|\n|-\n|cell\n|}\n" +
+		"<ref>some citation</ref> Body text with [[a link|link text]]."
+	patterns := compileSkipTagPatterns([]string{"ref"})
+	fallback := regexp.MustCompile("^file:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	out := CleanWikitext(text, patterns, nf)
+	want := "Intro.\n\n\nBody text with link text."
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestExtractLinksRescansImageCaptionForNestedLinks(t *testing.T) {
+	text := "[[File:Jane.jpg|thumb|A photo of [[Jane Doe]] at home]]"
+	links := ExtractLinks(text)
+	var targets []string
+	for _, l := range links {
+		targets = append(targets, l.Target)
+	}
+	want := []string{"File:Jane.jpg", "Jane Doe"}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("got %v, want %v", targets, want)
+	}
+}
+
+func TestExtractLinksPlainLinkHasNoSpuriousNestedEntries(t *testing.T) {
+	links := ExtractLinks("See [[Apollo 11|the mission]].")
+	if len(links) != 1 {
+		t.Fatalf("expected 1 link, got %d: %v", len(links), links)
+	}
+	if links[0].Target != "Apollo 11" || links[0].Anchor != "the mission" {
+		t.Errorf("got %+v", links[0])
+	}
+}
+
+func TestLinkExtractorEmitsNestedCaptionLink(t *testing.T) {
+	in := make(chan *Page)
+	out := make(chan *string, 10)
+	redirOut := make(chan *string, 10)
+	ack := make(chan bool)
+	fallback := regexp.MustCompile("^file:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	go LinkExtractor(in, out, redirOut, ack, nf)
+
+	in <- &Page{Title: "Someone", Text: "[[File:Jane.jpg|thumb|A photo of [[Jane Doe]] at home]]"}
+	in <- nil
+	<-ack
+	close(out)
+	close(redirOut)
+
+	var lines []string
+	for line := range out {
+		lines = append(lines, *line)
+	}
+	// File:Jane.jpg itself is dropped (excluded namespace), but the
+	// link nested in its caption still reaches the pagelinks graph.
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %d: %v", len(lines), lines)
+	}
+	if !strings.Contains(lines[0], "\tjane_doe\t") {
+		t.Errorf("expected a pagelinks line to Jane Doe, got %s", lines[0])
+	}
+}
+
+func TestArticleEncoderStripsAbstractTitlePrefix(t *testing.T) {
+	in := make(chan *Article)
+	out := make(chan *string, 10)
+	ack := make(chan bool)
+	fallback := regexp.MustCompile("^category:.*")
+	nf := NewNamespaceFilter("0", "", fallback)
+	go ArticleEncoder(in, out, ack, nf)
+
+	in <- &Article{Title: "Wikipedia: Apollo 11", URL: "https://en.wikipedia.org/wiki/Apollo_11", Abstract: "The first crewed Moon landing."}
+	in <- nil
+	<-ack
+	close(out)
+
+	var lines []string
+	for line := range out {
+		lines = append(lines, *line)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %d: %v", len(lines), lines)
+	}
+	if !strings.Contains(lines[0], `"ctitle":"apollo_11"`) {
+		t.Errorf("expected the Wikipedia: dump-artifact prefix stripped from ctitle, got %s", lines[0])
+	}
+}
+
+func TestExtractTemplatesNestedAndNamed(t *testing.T) {
+	text := "{{Infobox Space mission\n" +
+		"|mission_name=Apollo 11\n" +
+		"|birth_date={{birth date|1930|8|5}}\n" +
+		"}}"
+	results := ExtractTemplates(text, "Infobox Space mission")
+	if len(results) != 1 {
+		t.Fatalf("expected 1 occurrence, got %d", len(results))
+	}
+	want := map[string]string{
+		"mission_name": "Apollo 11",
+		"birth_date":   "{{birth date|1930|8|5}}",
+	}
+	if !reflect.DeepEqual(results[0], want) {
+		t.Errorf("got %v, want %v", results[0], want)
+	}
+}